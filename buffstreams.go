@@ -1,21 +1,49 @@
 package buffstreams
 
-import ()
-
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"log"
+	"math/bits"
 	"net"
 	"sync"
 )
 
+// Pairs a dialed-out net.Conn with the Channel built for it once the
+// handshake settles on a session. Reusing channel across writes, rather
+// than building a new one per call, is what lets its rate.Limiter's bucket
+// actually throttle anything. The embedded Mutex just serializes writes to
+// this one connection, not to every other destination too.
+type dialedConn struct {
+	sync.Mutex
+	conn    net.Conn
+	session *connSession
+	channel *Channel
+}
+
+// Tracks a listening socket plus the means to cancel its accept loop and
+// wait for its handler goroutines, so Shutdown can tear things down
+// cleanly.
+type listenerEntry struct {
+	socket net.Listener
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+}
+
 type BuffManager struct {
-	dialedConnections map[string]net.Conn
-	listeningSockets  map[string]net.Listener
+	dialedConnections map[string]*dialedConn
+	listeningSockets  map[string]*listenerEntry
+	// muxes are the Muxes registered via StartListeningMuxContext, kept
+	// around only so Shutdown can Close each one and let their worker
+	// goroutines stop.
+	muxes []*Mux
 	// TODO find a way to sanely provide this to a Dialer or a Receiver on a per-connection basis
 	MaxMessageSizeBitLength int
 	EnableLogging           bool
+	ConnOptions             ConnOptions
+	maxMessageSize          int
+	internalStats           *buffManagerStats
+	metrics                 MetricsSink
 	// TODO I could control access to the maps better if I centralized how they got accessed - less locking code littered around
 	sync.RWMutex
 }
@@ -23,154 +51,284 @@ type BuffManager struct {
 type BuffManagerConfig struct {
 	MaxMessageSize int
 	EnableLogging  bool
+	ConnOptions    ConnOptions
+	// If set, receives every traffic/error event this BuffManager's
+	// connections generate, on top of the counters Stats/TotalStats
+	// already track.
+	MetricsSink MetricsSink
 }
 
 func New(cfg BuffManagerConfig) *BuffManager {
+	internalStats := newBuffManagerStats()
+	sinks := fanoutSink{internalStats}
+	if cfg.MetricsSink != nil {
+		sinks = append(sinks, cfg.MetricsSink)
+	}
 	bm := &BuffManager{
-		dialedConnections: make(map[string]net.Conn),
-		listeningSockets:  make(map[string]net.Listener),
+		dialedConnections: make(map[string]*dialedConn),
+		listeningSockets:  make(map[string]*listenerEntry),
 		EnableLogging:     cfg.EnableLogging,
+		ConnOptions:       cfg.ConnOptions,
+		internalStats:     internalStats,
+		metrics:           sinks,
 	}
 	maxMessageSize := 4096
 	// 0 is the default, and the message must be atleast 1 byte large
 	if cfg.MaxMessageSize != 0 {
 		maxMessageSize = cfg.MaxMessageSize
 	}
+	bm.maxMessageSize = maxMessageSize
 	bm.MaxMessageSizeBitLength = MessageSizeToBitLength(maxMessageSize)
 	return bm
 }
 
+// Snapshot of the traffic/error counters for the connection to ip:port,
+// dialed out or accepted either way.
+func (bm *BuffManager) Stats(ip string, port string) ConnStats {
+	return bm.internalStats.snapshot(formatAddress(ip, port))
+}
+
+// Sum of Stats across every address this BuffManager has seen traffic for.
+func (bm *BuffManager) TotalStats() ConnStats {
+	return bm.internalStats.total()
+}
+
+// Cancels every listener's accept loop, closes every dialed connection,
+// then waits for in-flight handler goroutines to drain. Returns ctx's
+// error if its deadline passes before they do.
+func (bm *BuffManager) Shutdown(ctx context.Context) error {
+	bm.Lock()
+	listeners := make([]*listenerEntry, 0, len(bm.listeningSockets))
+	for address, l := range bm.listeningSockets {
+		listeners = append(listeners, l)
+		delete(bm.listeningSockets, address)
+	}
+	dialers := make([]*dialedConn, 0, len(bm.dialedConnections))
+	for address, d := range bm.dialedConnections {
+		dialers = append(dialers, d)
+		delete(bm.dialedConnections, address)
+	}
+	bm.Unlock()
+
+	bm.Lock()
+	muxes := bm.muxes
+	bm.muxes = nil
+	bm.Unlock()
+
+	for _, l := range listeners {
+		l.cancel()
+	}
+	for _, d := range dialers {
+		d.conn.Close()
+	}
+	for _, m := range muxes {
+		m.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for _, l := range listeners {
+			l.wg.Wait()
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Number of bits needed to represent maxMessageSize. Stored instead of the
+// raw byte count so headerByteSize can work out the actual varint header
+// size.
+func MessageSizeToBitLength(maxMessageSize int) int {
+	return bits.Len(uint(maxMessageSize))
+}
+
+// Bytes a base-128 varint needs to encode a value bitLength bits wide.
+// Using bitLength as a byte count directly, like this package used to,
+// overallocates and breaks as soon as the varint is shorter than that.
+func headerByteSize(bitLength int) int {
+	if bitLength == 0 {
+		return 1
+	}
+	return (bitLength + 6) / 7
+}
+
 type ListenCallback func([]byte) error
 
 func formatAddress(address string, port string) string {
 	return address + ":" + port
 }
 
+// StartListeningContext with context.Background(); use bm.Shutdown instead
+// if you want to tear every listener down together.
 func (bm *BuffManager) StartListening(port string, cb ListenCallback) error {
+	return bm.StartListeningContext(context.Background(), port, cb)
+}
+
+// Like StartListening, but the accept loop - and every handler goroutine
+// it's spawned - stops as soon as ctx is canceled.
+func (bm *BuffManager) StartListeningContext(ctx context.Context, port string, cb ListenCallback) error {
+	return bm.startListeningAddress(ctx, port, func(ctx context.Context, topic string, payload []byte) error {
+		return cb(payload)
+	})
+}
+
+// StartListeningMuxContext with context.Background().
+func (bm *BuffManager) StartListeningMux(port string, mux *Mux) error {
+	return bm.StartListeningMuxContext(context.Background(), port, mux)
+}
+
+// Like StartListeningContext, but for carrying more than one kind of
+// message over the same connection: every frame's topic gets looked up in
+// mux instead of going to a single ListenCallback.
+func (bm *BuffManager) StartListeningMuxContext(ctx context.Context, port string, mux *Mux) error {
+	bm.Lock()
+	bm.muxes = append(bm.muxes, mux)
+	bm.Unlock()
+	return bm.startListeningAddress(ctx, port, mux.dispatch)
+}
+
+func (bm *BuffManager) startListeningAddress(ctx context.Context, port string, dispatch func(ctx context.Context, topic string, payload []byte) error) error {
 	address := formatAddress("", port)
 	receiveSocket, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
-	bm.startListening(address, receiveSocket, cb)
+	bm.startListening(ctx, address, receiveSocket, dispatch)
 	return nil
 }
 
-func (bm *BuffManager) startListening(address string, socket net.Listener, cb ListenCallback) {
+func (bm *BuffManager) startListening(ctx context.Context, address string, socket net.Listener, dispatch func(ctx context.Context, topic string, payload []byte) error) {
+	ctx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+
 	bm.Lock()
-	bm.listeningSockets[address] = socket
+	bm.listeningSockets[address] = &listenerEntry{socket: socket, cancel: cancel, wg: wg}
 	bm.Unlock()
 
-	go func(address string, maxMessageSizeBitLength int, enableLogging bool, listener net.Listener) {
+	// Canceling ctx is the only way to stop listener.Accept() blocking
+	// forever.
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+
+	go func(address string, maxMessageSize int, connOptions ConnOptions, metrics MetricsSink, enableLogging bool, listener net.Listener) {
 		for {
 			// Wait for someone to connect
 			conn, err := listener.Accept()
 			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
 				if enableLogging == true {
 					log.Print("Error attempting to accept connection")
 					log.Print(err)
 				}
-			} else {
-				// Hand this off and immediately listen for more
-				go handleListenedConn(address, conn, bm.MaxMessageSizeBitLength, enableLogging, cb)
+				continue
+			}
+			if err := applyConnOptions(conn, connOptions); err != nil {
+				if enableLogging == true {
+					log.Printf("Address %s: Failed to apply connection options", address)
+					log.Print(err)
+				}
+				conn.Close()
+				continue
+			}
+			session, err := negotiateMaxMessageSize(conn, maxMessageSize, connOptions.HandshakeTimeout)
+			if err != nil {
+				metrics.HandshakeFailure(conn.RemoteAddr().String())
+				if enableLogging == true {
+					log.Printf("Address %s: Handshake failed", address)
+					log.Print(err)
+				}
+				conn.Close()
+				continue
 			}
+			// Hand this off and immediately listen for more
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleListenedConn(ctx, address, conn, session, connOptions, metrics, enableLogging, dispatch)
+			}()
 		}
-	}(address, bm.MaxMessageSizeBitLength, bm.EnableLogging, socket)
+	}(address, bm.maxMessageSize, bm.ConnOptions, bm.metrics, bm.EnableLogging, socket)
 }
 
-func handleListenedConn(address string, conn net.Conn, maxMessageSize int, enableLogging bool, cb ListenCallback) {
+func handleListenedConn(ctx context.Context, address string, conn net.Conn, session *connSession, connOptions ConnOptions, metrics MetricsSink, enableLogging bool, dispatch func(ctx context.Context, topic string, payload []byte) error) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	metrics.ActiveConns(remoteAddr, 1)
+	defer metrics.ActiveConns(remoteAddr, -1)
+
+	// conn.Read doesn't know about context cancellation, so closing the
+	// conn out from under it is the only way to unblock it.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	channel := NewChannel(conn, ChannelConfig{
+		HeaderByteSize: session.headerByteSize,
+		MaxMessageSize: session.maxMessageSize,
+		ConnOptions:    connOptions,
+		Metrics:        metrics,
+		Address:        remoteAddr,
+	})
 	for {
-		// Handle getting the data header
-		headerByteSize := maxMessageSize
-		headerBuffer := make([]byte, headerByteSize)
-		// First, read the number of bytes required to determine the message length
-		_, err := readFromConnection(conn, headerBuffer)
-		if err != nil && err.Error() == "EOF" {
-			// Log the error we got from the call to read
+		frame, err := channel.ReadMessage(ctx)
+		if err != nil {
 			if enableLogging == true {
-				log.Printf("Address %s: Client closed connection", address)
+				if err.Error() == "EOF" {
+					log.Printf("Address %s: Client closed connection", address)
+				} else {
+					log.Printf("Address %s: Failure to read from connection", address)
+				}
 				log.Print(err)
 			}
-			conn.Close()
 			return
 		}
 
-		// Now turn that buffer of bytes into an integer - represnts size of message body
-		msgLength, bytesParsed := binary.Uvarint(headerBuffer)
-		// Not sure what the correct way to handle these errors are. For now, bomb out
-		if bytesParsed == 0 {
-			// "Buffer too small"
-			if enableLogging == true {
-				log.Printf("Address %s: 0 Bytes parsed from header", address)
-				log.Print(err)
-			}
-			conn.Close()
-			return
-		} else if bytesParsed < 0 {
-			// "Buffer overflow"
-			if enableLogging == true {
-				log.Printf("Address %s: Buffer Less than zero bytes parsed from header", address)
-				log.Print(err)
-			}
-			conn.Close()
-			return
-		}
-		dataBuffer := make([]byte, msgLength)
-		bytesLen, err := readFromConnection(conn, dataBuffer)
-		if err != nil && err.Error() == "EOF" {
-			// log the error from the call to read
+		topic, payload, err := decodeTopicFrame(frame)
+		if err != nil {
 			if enableLogging == true {
-				log.Printf("Address %s: Failure to read from connection", address)
+				log.Printf("Address %s: Malformed topic header", address)
 				log.Print(err)
 			}
-			conn.Close()
-			return
+			continue
 		}
 
-		// If we read bytes, there wasn't an error, or if there was it was only EOF
-		// And readbytes + EOF is normal, just as readbytes + no err, next read 0 bytes EOF
-		// So... we take action on the actual message data
-		if bytesLen > 0 && (err == nil || (err != nil && err.Error() == "EOF")) {
-			// I ultimately have some design choices here
-			// Currently, I am invoking a delegate thats been passed down the stack
-			// I could...
-			// Just push it onto a queue (not a slow ass channel, but a queue)
-			// which has a reference passed down to it, and the main process
-			// spawns a goroutine to reap off the queue and handle those in parallel
-
-			// Callback, atm
-			err = cb(dataBuffer)
-			if err != nil && enableLogging == true {
-				log.Printf("Error in Callback")
-				log.Print(err)
-			}
-		}
-	}
-}
+		// I ultimately have some design choices here
+		// Currently, I am invoking a delegate thats been passed down the stack
+		// I could...
+		// Just push it onto a queue (not a slow ass channel, but a queue)
+		// which has a reference passed down to it, and the main process
+		// spawns a goroutine to reap off the queue and handle those in parallel
 
-func readFromConnection(reader net.Conn, buffer []byte) (int, error) {
-	// This fills the buffer
-	bytesLen, err := reader.Read(buffer)
-	// Output the content of the bytes to the queue
-	if bytesLen == 0 {
-		if err != nil && err.Error() == "EOF" {
-			// "End of individual transmission"
-			// We're just done reading from that conn
-			return bytesLen, err
+		// Callback, atm
+		if err := dispatch(ctx, topic, payload); err != nil && enableLogging == true {
+			log.Printf("Error in Callback")
+			log.Print(err)
 		}
 	}
-
-	if err != nil {
-		//"Underlying network failure?"
-		// Not sure what this error would be, but it could exist and i've seen it handled
-		// as a general case in other networking code. Following in the footsteps of (greatness|madness)
-	}
-	// Read some bytes, return the length
-	return bytesLen, nil
 }
 
-// If you want to dial out but not immediately write, use this method
+// DialOutContext with context.Background(). If you want to dial out but
+// not immediately write, use this method.
 func (bm *BuffManager) DialOut(ip string, port string) error {
+	return bm.DialOutContext(context.Background(), ip, port)
+}
+
+// Like DialOut, but the dial itself can be bounded or canceled via ctx
+// (context.WithTimeout, say).
+func (bm *BuffManager) DialOutContext(ctx context.Context, ip string, port string) error {
 	address := formatAddress(ip, port)
 	bm.RLock()
 	if _, ok := bm.dialedConnections[address]; ok == true {
@@ -179,61 +337,140 @@ func (bm *BuffManager) DialOut(ip string, port string) error {
 		return errors.New("You have a connection to this ip and port open already")
 	}
 	bm.RUnlock()
-	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err := applyConnOptions(conn, bm.ConnOptions); err != nil {
+		conn.Close()
+		return err
+	}
+	session, err := negotiateMaxMessageSize(conn, bm.maxMessageSize, bm.ConnOptions.HandshakeTimeout)
 	if err != nil {
+		bm.metrics.HandshakeFailure(address)
+		conn.Close()
 		return err
-	} else {
-		// Store the connection, it's valid
-		bm.Lock()
-		bm.dialedConnections[address] = conn
-		bm.Unlock()
 	}
+	channel := NewChannel(conn, ChannelConfig{
+		HeaderByteSize: session.headerByteSize,
+		MaxMessageSize: session.maxMessageSize,
+		ConnOptions:    bm.ConnOptions,
+		Metrics:        bm.metrics,
+		Address:        address,
+	})
+	// Store the connection, it's valid
+	bm.Lock()
+	bm.dialedConnections[address] = &dialedConn{conn: conn, session: session, channel: channel}
+	bm.Unlock()
+	bm.metrics.ActiveConns(address, 1)
 	return nil
 }
 
+// DialContext with context.Background().
+func (bm *BuffManager) Dial(ip string, port string) (*Channel, error) {
+	return bm.DialContext(context.Background(), ip, port)
+}
+
+// Like DialOutContext, but hands the Channel straight back instead of
+// managing it internally, for callers who want pull semantics - ranging
+// over ReadMessage themselves - rather than WriteTo/StartListening's push
+// style. The caller owns the returned Channel and is responsible for
+// closing it; this BuffManager doesn't track it and won't close it from
+// Shutdown.
+func (bm *BuffManager) DialContext(ctx context.Context, ip string, port string) (*Channel, error) {
+	address := formatAddress(ip, port)
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyConnOptions(conn, bm.ConnOptions); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	session, err := negotiateMaxMessageSize(conn, bm.maxMessageSize, bm.ConnOptions.HandshakeTimeout)
+	if err != nil {
+		bm.metrics.HandshakeFailure(address)
+		conn.Close()
+		return nil, err
+	}
+	return NewChannel(conn, ChannelConfig{
+		HeaderByteSize: session.headerByteSize,
+		MaxMessageSize: session.maxMessageSize,
+		ConnOptions:    bm.ConnOptions,
+		Metrics:        bm.metrics,
+		Address:        address,
+	}), nil
+}
+
 func (bm *BuffManager) CloseDialer(ip string, port string) error {
 	address := formatAddress(ip, port)
 	bm.Lock()
-	if _, ok := bm.dialedConnections[address]; ok != true {
-		err := bm.dialedConnections[address].Close()
+	if _, ok := bm.dialedConnections[address]; ok == true {
+		err := bm.dialedConnections[address].conn.Close()
 		delete(bm.dialedConnections, address)
 		bm.Unlock()
+		bm.metrics.ActiveConns(address, -1)
 		return err
 	}
 	bm.Unlock()
 	return nil
 }
 
-// Write data and dial out if the conn isn't open
+// WriteToContext with context.Background(). Write data and dial out if
+// the conn isn't open.
 func (bm *BuffManager) WriteTo(ip string, port string, data []byte, persist bool) (int, error) {
+	return bm.WriteToContext(context.Background(), ip, port, data, persist)
+}
+
+// Like WriteTo, but dialing out (if needed) can be bounded or canceled via
+// ctx.
+func (bm *BuffManager) WriteToContext(ctx context.Context, ip string, port string, data []byte, persist bool) (int, error) {
+	return bm.WriteToTopicContext(ctx, ip, port, defaultTopic, data, persist)
+}
+
+// WriteToTopicContext with context.Background().
+func (bm *BuffManager) WriteToTopic(ip string, port string, topic string, data []byte, persist bool) (int, error) {
+	return bm.WriteToTopicContext(context.Background(), ip, port, topic, data, persist)
+}
+
+// Like WriteTo, but tags data with topic so a receiver using
+// StartListeningMux routes it to the right handler. Peers on the plain
+// byte-only API never see the header - it's just the frame's default ("")
+// topic, stripped before their ListenCallback runs.
+func (bm *BuffManager) WriteToTopicContext(ctx context.Context, ip string, port string, topic string, data []byte, persist bool) (int, error) {
 	address := formatAddress(ip, port)
 	// Get the connection if it's cached, or open a new one
 	bm.RLock()
-	if _, ok := bm.dialedConnections[address]; ok != true {
-		bm.RUnlock()
-		err := bm.DialOut(ip, port)
+	_, ok := bm.dialedConnections[address]
+	bm.RUnlock()
+	if ok != true {
+		err := bm.DialOutContext(ctx, ip, port)
 		if err != nil {
 			// Error dialing out, cannot write
 			// bail
 			return 0, err
 		}
-	} else {
-		bm.RUnlock()
 	}
-	// Calculate how big the message is, using a consistent header size.
-	toWriteLen := UInt16ToByteArray(uint16(len(data)), bm.MaxMessageSizeBitLength)
-	// Append the size to the message, so now it has a header
-	toWrite := append(toWriteLen, data...)
-	bm.Lock()
-	written, err := bm.dialedConnections[address].Write(toWrite)
-	bm.Unlock()
+
+	bm.RLock()
+	dialed := bm.dialedConnections[address]
+	bm.RUnlock()
+
+	frame, err := encodeTopicFrame(topic, data)
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock this connection, not the whole BuffManager, so writes to other
+	// destinations don't serialize behind this one.
+	dialed.Lock()
+	written, err := dialed.channel.WriteMessage(ctx, frame)
+	dialed.Unlock()
 	if err != nil || persist == true {
-		err := bm.CloseDialer(ip, port)
-		if err != nil {
+		closeErr := bm.CloseDialer(ip, port)
+		if closeErr != nil {
 			// TODO ponder the following:
 			// Error closing the dialer, should we still return 0 written?
 			// What if some bytes written, then failure, then also the close throws an error
@@ -243,7 +480,7 @@ func (bm *BuffManager) WriteTo(ip string, port string, data []byte, persist bool
 				// The error will get returned up the stack, no need to log it here?
 				log.Print("There was an error writing the message, and a subsequent error cleaning up the connection")
 			}
-			return 0, err
+			return written, closeErr
 		}
 	}
 	// Return the bytes written, any error
@@ -0,0 +1,105 @@
+package buffstreams
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWriteToTopicContextReusesRateLimiter guards against the regression
+// where WriteToTopicContext built a fresh Channel - and so a fresh
+// rate.Limiter - on every call, which reset ConnOptions.MaxBytesPerSec's
+// token bucket to full each write and defeated the cap entirely. With the
+// limiter persisted on the dialedConn, a write that exhausts most of the
+// bucket must make the very next write wait for it to refill.
+func TestWriteToTopicContextReusesRateLimiter(t *testing.T) {
+	port, err := freeTCPPort(t)
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+
+	server := New(BuffManagerConfig{})
+	listenCtx, cancelListen := context.WithCancel(context.Background())
+	defer cancelListen()
+	if err := server.StartListeningContext(listenCtx, port, func([]byte) error { return nil }); err != nil {
+		t.Fatalf("StartListeningContext: %v", err)
+	}
+
+	// MaxMessageSize is kept small too, so the limiter's burst - sized to
+	// fit one max-size frame - stays small enough for two 10-byte writes
+	// to actually exhaust it.
+	client := New(BuffManagerConfig{
+		MaxMessageSize: 20,
+		ConnOptions:    ConnOptions{MaxBytesPerSec: 20},
+	})
+	defer client.Shutdown(context.Background())
+
+	data := make([]byte, 10)
+	if _, err := client.WriteTo("127.0.0.1", port, data, false); err != nil {
+		t.Fatalf("first WriteTo: %v", err)
+	}
+
+	writeCtx, cancelWrite := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelWrite()
+	if _, err := client.WriteToContext(writeCtx, "127.0.0.1", port, data, false); err == nil {
+		t.Fatal("second write should have blocked on the exhausted rate limiter, but succeeded immediately")
+	}
+}
+
+// TestDialContextReturnsUsableChannel guards against pull-style callers
+// having no supported way to get a handshaken, option-applied Channel for
+// an outbound connection: DialContext should hand back a Channel good
+// enough to read/write messages on directly.
+func TestDialContextReturnsUsableChannel(t *testing.T) {
+	port, err := freeTCPPort(t)
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+
+	server := New(BuffManagerConfig{})
+	listenCtx, cancelListen := context.WithCancel(context.Background())
+	defer cancelListen()
+	received := make(chan []byte, 1)
+	if err := server.StartListeningContext(listenCtx, port, func(data []byte) error {
+		received <- data
+		return nil
+	}); err != nil {
+		t.Fatalf("StartListeningContext: %v", err)
+	}
+
+	client := New(BuffManagerConfig{})
+	channel, err := client.DialContext(context.Background(), "127.0.0.1", port)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer channel.Close()
+
+	frame, err := encodeTopicFrame(defaultTopic, []byte("hello"))
+	if err != nil {
+		t.Fatalf("encodeTopicFrame: %v", err)
+	}
+	if _, err := channel.WriteMessage(context.Background(), frame); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if string(got) != "hello" {
+			t.Fatalf("server received %q, want %q", got, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server never received the message written over the dialed Channel")
+	}
+}
+
+func freeTCPPort(t *testing.T) (string, error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
@@ -0,0 +1,149 @@
+package buffstreams
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Returned by ReadMessage when its headerByteSize bytes don't hold a valid
+// varint, and by decodeTopicFrame when a frame is shorter than its topic
+// header says.
+var errShortHeader = errors.New("buffstreams: could not parse message header")
+
+// What a Channel needs to frame messages on a net.Conn: the sizes agreed
+// during the handshake, the per-connection options, and where to send
+// metrics.
+type ChannelConfig struct {
+	HeaderByteSize int
+	MaxMessageSize int
+	ConnOptions    ConnOptions
+	Metrics        MetricsSink
+	// Just an identifier for metrics, doesn't need to be unique
+	Address string
+}
+
+// Wraps a net.Conn and does the length-prefixed read/write framing. One
+// goroutine can read while another writes, but don't call the same method
+// from two goroutines at once.
+type Channel struct {
+	conn           net.Conn
+	headerByteSize int
+	maxMessageSize int
+	opts           ConnOptions
+	metrics        MetricsSink
+	address        string
+	limiter        *rate.Limiter
+}
+
+// Wraps conn in a Channel using cfg's framing and connection options.
+func NewChannel(conn net.Conn, cfg ChannelConfig) *Channel {
+	metrics := cfg.Metrics
+	if metrics == nil {
+		metrics = noopMetricsSink{}
+	}
+	var limiter *rate.Limiter
+	if cfg.ConnOptions.MaxBytesPerSec > 0 {
+		// Burst has to cover the biggest single frame this Channel can see
+		// (header + max message size), or WaitN rejects it outright instead
+		// of throttling it - MaxBytesPerSec is a rate, not a per-message cap.
+		burst := cfg.ConnOptions.MaxBytesPerSec
+		if frame := cfg.HeaderByteSize + cfg.MaxMessageSize; frame > burst {
+			burst = frame
+		}
+		limiter = rate.NewLimiter(rate.Limit(cfg.ConnOptions.MaxBytesPerSec), burst)
+	}
+	return &Channel{
+		conn:           conn,
+		headerByteSize: cfg.HeaderByteSize,
+		maxMessageSize: cfg.MaxMessageSize,
+		opts:           cfg.ConnOptions,
+		metrics:        metrics,
+		address:        cfg.Address,
+		limiter:        limiter,
+	}
+}
+
+// Blocks until a full framed message has come in. Returns io.EOF once the
+// peer closes cleanly between messages, ErrTooLarge if its header claims a
+// message bigger than we'll accept.
+func (c *Channel) ReadMessage(ctx context.Context) ([]byte, error) {
+	if c.opts.ReadDeadline > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.opts.ReadDeadline)); err != nil {
+			return nil, err
+		}
+	}
+
+	headerBuffer := make([]byte, c.headerByteSize)
+	if _, err := io.ReadFull(c.conn, headerBuffer); err != nil {
+		return nil, err
+	}
+
+	msgLength, bytesParsed := binary.Uvarint(headerBuffer)
+	if bytesParsed <= 0 {
+		c.metrics.FramingError(c.address)
+		return nil, errShortHeader
+	}
+	if c.maxMessageSize > 0 && msgLength > uint64(c.maxMessageSize) {
+		c.metrics.FramingError(c.address)
+		return nil, ErrTooLarge
+	}
+
+	if c.limiter != nil {
+		if err := c.limiter.WaitN(ctx, c.headerByteSize+int(msgLength)); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.opts.ReadDeadline > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.opts.ReadDeadline)); err != nil {
+			return nil, err
+		}
+	}
+	dataBuffer := make([]byte, msgLength)
+	if _, err := io.ReadFull(c.conn, dataBuffer); err != nil {
+		return nil, err
+	}
+
+	c.metrics.BytesIn(c.address, c.headerByteSize+len(dataBuffer))
+	c.metrics.MessagesIn(c.address)
+	return dataBuffer, nil
+}
+
+// Writes data as a single framed message, returning bytes written (header
+// + body). Returns ErrTooLarge without writing anything if data is over
+// the configured max.
+func (c *Channel) WriteMessage(ctx context.Context, data []byte) (int, error) {
+	if c.maxMessageSize > 0 && len(data) > c.maxMessageSize {
+		return 0, ErrTooLarge
+	}
+	if c.limiter != nil {
+		if err := c.limiter.WaitN(ctx, c.headerByteSize+len(data)); err != nil {
+			return 0, err
+		}
+	}
+	if c.opts.WriteDeadline > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteDeadline)); err != nil {
+			return 0, err
+		}
+	}
+	headerBuffer := make([]byte, c.headerByteSize)
+	binary.PutUvarint(headerBuffer, uint64(len(data)))
+	written, err := c.conn.Write(append(headerBuffer, data...))
+	if err != nil {
+		return written, err
+	}
+	c.metrics.BytesOut(c.address, written)
+	c.metrics.MessagesOut(c.address)
+	return written, nil
+}
+
+// Close closes the underlying connection.
+func (c *Channel) Close() error {
+	return c.conn.Close()
+}
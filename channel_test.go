@@ -0,0 +1,91 @@
+package buffstreams
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestChannelReadMessageAcrossShortReads guards against ReadMessage assuming
+// a single conn.Read call returns a whole header or a whole message body.
+// Real TCP sockets routinely split one logical write across several reads,
+// so this delivers the same frame to the Channel in multiple small writes
+// over a net.Pipe instead of one.
+func TestChannelReadMessageAcrossShortReads(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	maxMessageSize := 4096
+	headerSize := headerByteSize(MessageSizeToBitLength(maxMessageSize))
+	channel := NewChannel(server, ChannelConfig{
+		HeaderByteSize: headerSize,
+		MaxMessageSize: maxMessageSize,
+	})
+
+	payload := bytes.Repeat([]byte("x"), 50)
+	frame := make([]byte, headerSize)
+	binary.PutUvarint(frame, uint64(len(payload)))
+	frame = append(frame, payload...)
+
+	go func() {
+		for _, chunk := range chunksOf(frame, 3) {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	got, err := channel.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("ReadMessage returned error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("ReadMessage returned %q, want %q", got, payload)
+	}
+}
+
+// TestChannelWriteMessageLargerThanMaxBytesPerSec guards against the
+// rate.Limiter's burst being set equal to MaxBytesPerSec: since WaitN
+// rejects any request bigger than the burst, a single frame larger than
+// the configured rate used to fail every time instead of being throttled
+// across multiple seconds.
+func TestChannelWriteMessageLargerThanMaxBytesPerSec(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	maxMessageSize := 100
+	headerSize := headerByteSize(MessageSizeToBitLength(maxMessageSize))
+	channel := NewChannel(client, ChannelConfig{
+		HeaderByteSize: headerSize,
+		MaxMessageSize: maxMessageSize,
+		ConnOptions:    ConnOptions{MaxBytesPerSec: 5},
+	})
+
+	go io.Copy(io.Discard, server)
+
+	payload := bytes.Repeat([]byte("x"), 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := channel.WriteMessage(ctx, payload); err != nil {
+		t.Fatalf("WriteMessage returned %v, want the write to succeed (throttled, not rejected)", err)
+	}
+}
+
+func chunksOf(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
@@ -0,0 +1,65 @@
+package buffstreams
+
+import (
+	"net"
+	"time"
+)
+
+// Per-connection socket and per-message options, whether dialed out via
+// DialOut or accepted by a listener. Zero-valued buffer sizes, keepalive
+// period, deadlines and rate cap are left unapplied; NoDelay and KeepAlive
+// are always applied, so leaving them false turns both off on the conn.
+type ConnOptions struct {
+	// SO_RCVBUF / SO_SNDBUF sizes, in bytes. Zero leaves them alone.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Disables Nagle's algorithm - more throughput vs lower latency.
+	NoDelay bool
+	// Enables TCP keepalive probes. KeepAlivePeriod overrides the OS's
+	// default probe interval if set.
+	KeepAlive       bool
+	KeepAlivePeriod time.Duration
+	// Applied before every Read/Write so a stalled peer can't wedge a
+	// handler goroutine forever.
+	ReadDeadline  time.Duration
+	WriteDeadline time.Duration
+	// How long the handshake gets before we give up on it.
+	HandshakeTimeout time.Duration
+	// Caps combined read+write throughput at this many bytes/sec, via a
+	// golang.org/x/time/rate limiter shared across ReadMessage and
+	// WriteMessage. Zero means no cap.
+	MaxBytesPerSec int
+}
+
+// Applies opts' kernel-level settings to conn. Buffer sizes and the
+// keepalive period are skipped when zero; NoDelay and KeepAlive are always
+// set to opts' values. No-op for conns that aren't *net.TCPConn (net.Pipe
+// in tests, say).
+func applyConnOptions(conn net.Conn, opts ConnOptions) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if opts.ReadBufferSize > 0 {
+		if err := tcpConn.SetReadBuffer(opts.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if opts.WriteBufferSize > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+	if err := tcpConn.SetNoDelay(opts.NoDelay); err != nil {
+		return err
+	}
+	if err := tcpConn.SetKeepAlive(opts.KeepAlive); err != nil {
+		return err
+	}
+	if opts.KeepAlive && opts.KeepAlivePeriod > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(opts.KeepAlivePeriod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
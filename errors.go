@@ -0,0 +1,11 @@
+package buffstreams
+
+import "errors"
+
+// ErrTooLarge is returned by Channel.ReadMessage when a peer's header
+// advertises a message length greater than the connection's configured
+// maximum message size. On a StartListening connection it is logged (if
+// logging is enabled) and the connection is closed; the ListenCallback
+// never sees it. Without this check a hostile or misbehaving peer could make
+// ReadMessage allocate an arbitrarily large buffer.
+var ErrTooLarge = errors.New("buffstreams: message exceeds configured maximum size")
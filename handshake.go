@@ -0,0 +1,90 @@
+package buffstreams
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Bump whenever the framing format changes in a way older peers can't
+// understand.
+const protocolVersion = uint8(1)
+
+// Identifies a buffstreams connection before either side reads or writes
+// framed messages on it.
+var handshakeMagic = [8]byte{'b', 'u', 'f', 'f', 's', 't', 'r', 'm'}
+
+// Fixed size of a handshake message: magic + protocol version + varint
+// proposed max message size.
+const handshakeMessageLen = len(handshakeMagic) + 1 + binary.MaxVarintLen64
+
+// Returned when a connection's handshake fails - bad magic, an
+// incompatible protocol version, or a timeout.
+type HandshakeError struct {
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("buffstreams: handshake failed: %s", e.Reason)
+}
+
+// Per-connection state agreed during the handshake. Stored on the
+// connection instead of read off bm.MaxMessageSizeBitLength each message,
+// so two peers configured with different maximums don't mis-frame each
+// other, and nothing races with a later change to the BuffManager's config.
+type connSession struct {
+	maxMessageSize int
+	headerByteSize int
+}
+
+// Proposes maxMessageSize to the peer, reads back its proposal, and
+// settles on the smaller of the two so neither side ever frames a message
+// the other can't read. timeout, if non-zero, bounds the whole exchange.
+func negotiateMaxMessageSize(conn net.Conn, maxMessageSize int, timeout time.Duration) (*connSession, error) {
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	out := make([]byte, handshakeMessageLen)
+	copy(out, handshakeMagic[:])
+	out[len(handshakeMagic)] = protocolVersion
+	binary.PutUvarint(out[len(handshakeMagic)+1:], uint64(maxMessageSize))
+	if _, err := conn.Write(out); err != nil {
+		return nil, &HandshakeError{Reason: "failed to write handshake: " + err.Error()}
+	}
+
+	in := make([]byte, handshakeMessageLen)
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return nil, &HandshakeError{Reason: "failed to read handshake: " + err.Error()}
+	}
+	if string(in[:len(handshakeMagic)]) != string(handshakeMagic[:]) {
+		return nil, &HandshakeError{Reason: "bad magic"}
+	}
+	peerVersion := in[len(handshakeMagic)]
+	if peerVersion != protocolVersion {
+		return nil, &HandshakeError{Reason: fmt.Sprintf("unsupported protocol version %d", peerVersion)}
+	}
+	peerMaxMessageSize, bytesParsed := binary.Uvarint(in[len(handshakeMagic)+1:])
+	if bytesParsed <= 0 {
+		return nil, &HandshakeError{Reason: "malformed proposed max message size"}
+	}
+
+	agreed := maxMessageSize
+	if int(peerMaxMessageSize) < agreed {
+		agreed = int(peerMaxMessageSize)
+	}
+	return &connSession{
+		maxMessageSize: agreed,
+		headerByteSize: headerByteSize(MessageSizeToBitLength(agreed)),
+	}, nil
+}
@@ -0,0 +1,118 @@
+package buffstreams
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Workers per topic, and how many pending messages a topic buffers before
+// dispatch starts blocking (i.e. backpressure onto the connection).
+const (
+	defaultMuxWorkers   = 4
+	defaultMuxQueueSize = 64
+)
+
+// Routes framed messages to handlers registered per topic, so one
+// BuffManager listener can carry more than one kind of message without
+// every caller writing its own dispatch logic. Each topic gets its own
+// worker pool and error channel, so one slow/failing handler can't block
+// another topic.
+type Mux struct {
+	handlers  map[string]*muxHandler
+	defaultCB ListenCallback
+	sync.RWMutex
+}
+
+type muxHandler struct {
+	queue chan []byte
+	errs  chan error
+}
+
+// Empty Mux. Register topics with Handle (and maybe a fallback with
+// HandleDefault) before passing it to StartListeningMux.
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[string]*muxHandler)}
+}
+
+// Registers cb for topic. Runs across defaultMuxWorkers goroutines reading
+// off a queue of depth defaultMuxQueueSize - once full, dispatch blocks
+// until a worker frees up, so a slow handler backs up instead of growing
+// the queue unbounded.
+func (m *Mux) Handle(topic string, cb ListenCallback) {
+	h := &muxHandler{
+		queue: make(chan []byte, defaultMuxQueueSize),
+		errs:  make(chan error, defaultMuxQueueSize),
+	}
+	for i := 0; i < defaultMuxWorkers; i++ {
+		go func() {
+			for data := range h.queue {
+				if err := cb(data); err != nil {
+					h.errs <- err
+				}
+			}
+		}()
+	}
+	m.Lock()
+	m.handlers[topic] = h
+	m.Unlock()
+}
+
+// Fallback handler, invoked on the dispatching goroutine, for any topic
+// without one registered via Handle.
+func (m *Mux) HandleDefault(cb ListenCallback) {
+	m.Lock()
+	m.defaultCB = cb
+	m.Unlock()
+}
+
+// topic's error channel, or nil if nothing's registered for it.
+func (m *Mux) Errors(topic string) <-chan error {
+	m.RLock()
+	defer m.RUnlock()
+	if h, ok := m.handlers[topic]; ok {
+		return h.errs
+	}
+	return nil
+}
+
+// Routes data to topic's handler, blocking until either a worker frees up
+// queue space or ctx is canceled - the cancel path is what lets a
+// handleListenedConn goroutine escape a stuck topic during shutdown
+// instead of blocking forever. Falls back to defaultCB if topic has no
+// handler.
+func (m *Mux) dispatch(ctx context.Context, topic string, data []byte) error {
+	m.RLock()
+	h, ok := m.handlers[topic]
+	defaultCB := m.defaultCB
+	m.RUnlock()
+	if ok {
+		select {
+		case h.queue <- data:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if defaultCB != nil {
+		return defaultCB(data)
+	}
+	return fmt.Errorf("buffstreams: no handler registered for topic %q", topic)
+}
+
+// Stops every topic's worker pool by closing its queue, so each worker's
+// `for data := range h.queue` returns once drained. Call this when the Mux
+// is done with, or the workers leak for the life of the process. bm.Shutdown
+// already calls it for every Mux passed to StartListeningMux; a second call
+// panics, since the queues are already closed.
+func (m *Mux) Close() {
+	m.Lock()
+	handlers := make([]*muxHandler, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		handlers = append(handlers, h)
+	}
+	m.Unlock()
+	for _, h := range handlers {
+		close(h.queue)
+	}
+}
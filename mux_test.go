@@ -0,0 +1,79 @@
+package buffstreams
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMuxDispatchUnblocksOnContextCancel guards against dispatch blocking
+// forever once a topic's workers and queue are all saturated: a canceled
+// ctx must still let it return, rather than wedging handleListenedConn's
+// read loop during shutdown.
+func TestMuxDispatchUnblocksOnContextCancel(t *testing.T) {
+	m := NewMux()
+	block := make(chan struct{})
+	defer close(block)
+	m.Handle("stuck", func(data []byte) error {
+		<-block
+		return nil
+	})
+
+	// Fill every worker and the whole queue so the next dispatch has
+	// nowhere to go.
+	for i := 0; i < defaultMuxWorkers+defaultMuxQueueSize; i++ {
+		if err := m.dispatch(context.Background(), "stuck", []byte("x")); err != nil {
+			t.Fatalf("dispatch %d: unexpected error filling the queue: %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.dispatch(ctx, "stuck", []byte("x")); err != ctx.Err() {
+		t.Fatalf("dispatch on a saturated topic returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestMuxCloseStopsWorkers guards against the worker goroutine leak: Close
+// must close every topic's queue so its `for data := range h.queue`
+// workers return instead of blocking forever.
+func TestMuxCloseStopsWorkers(t *testing.T) {
+	m := NewMux()
+	var wg sync.WaitGroup
+	wg.Add(defaultMuxWorkers)
+	m.Handle("topic", func(data []byte) error {
+		wg.Done()
+		return nil
+	})
+	for i := 0; i < defaultMuxWorkers; i++ {
+		if err := m.dispatch(context.Background(), "topic", []byte("x")); err != nil {
+			t.Fatalf("dispatch: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("workers never processed their messages")
+	}
+
+	m.Close()
+
+	m.RLock()
+	h := m.handlers["topic"]
+	m.RUnlock()
+	select {
+	case _, ok := <-h.queue:
+		if ok {
+			t.Fatal("queue should be drained and closed after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not close the topic's queue")
+	}
+}
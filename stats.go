@@ -0,0 +1,197 @@
+package buffstreams
+
+import "sync"
+
+// Point-in-time snapshot of the traffic/error counters for one address.
+type ConnStats struct {
+	BytesIn           uint64
+	BytesOut          uint64
+	MessagesIn        uint64
+	MessagesOut       uint64
+	ActiveConns       int
+	HandshakeFailures uint64
+	FramingErrors     uint64
+}
+
+// Receives increment callbacks from every connection's read/write path.
+// buffstreams only depends on this interface - expvar/Prometheus sinks can
+// live in subpackages - and keeps its own copy of the counters for
+// Stats/TotalStats either way.
+type MetricsSink interface {
+	BytesIn(address string, n int)
+	BytesOut(address string, n int)
+	MessagesIn(address string)
+	MessagesOut(address string)
+	ActiveConns(address string, delta int)
+	HandshakeFailure(address string)
+	FramingError(address string)
+}
+
+// Discards every event, so Channel/BuffManager can call bm.metrics
+// unconditionally instead of nil-checking before every increment.
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) BytesIn(string, int)     {}
+func (noopMetricsSink) BytesOut(string, int)    {}
+func (noopMetricsSink) MessagesIn(string)       {}
+func (noopMetricsSink) MessagesOut(string)      {}
+func (noopMetricsSink) ActiveConns(string, int) {}
+func (noopMetricsSink) HandshakeFailure(string) {}
+func (noopMetricsSink) FramingError(string)     {}
+
+// Forwards every MetricsSink call to each member, so a BuffManager can
+// keep its own Stats()/TotalStats() bookkeeping and forward the same
+// events to a caller-supplied sink without either knowing about the other.
+type fanoutSink []MetricsSink
+
+func (f fanoutSink) BytesIn(address string, n int) {
+	for _, s := range f {
+		s.BytesIn(address, n)
+	}
+}
+
+func (f fanoutSink) BytesOut(address string, n int) {
+	for _, s := range f {
+		s.BytesOut(address, n)
+	}
+}
+
+func (f fanoutSink) MessagesIn(address string) {
+	for _, s := range f {
+		s.MessagesIn(address)
+	}
+}
+
+func (f fanoutSink) MessagesOut(address string) {
+	for _, s := range f {
+		s.MessagesOut(address)
+	}
+}
+
+func (f fanoutSink) ActiveConns(address string, delta int) {
+	for _, s := range f {
+		s.ActiveConns(address, delta)
+	}
+}
+
+func (f fanoutSink) HandshakeFailure(address string) {
+	for _, s := range f {
+		s.HandshakeFailure(address)
+	}
+}
+
+func (f fanoutSink) FramingError(address string) {
+	for _, s := range f {
+		s.FramingError(address)
+	}
+}
+
+// Mutable counter set backing a single address's ConnStats snapshot.
+type connStats struct {
+	sync.Mutex
+	ConnStats
+}
+
+// The in-process MetricsSink every BuffManager keeps for itself,
+// independent of any caller-supplied sink, so Stats/TotalStats always have
+// something to report.
+type buffManagerStats struct {
+	sync.Mutex
+	byAddress map[string]*connStats
+}
+
+func newBuffManagerStats() *buffManagerStats {
+	return &buffManagerStats{byAddress: make(map[string]*connStats)}
+}
+
+func (s *buffManagerStats) entry(address string) *connStats {
+	s.Lock()
+	defer s.Unlock()
+	cs, ok := s.byAddress[address]
+	if !ok {
+		cs = &connStats{}
+		s.byAddress[address] = cs
+	}
+	return cs
+}
+
+func (s *buffManagerStats) BytesIn(address string, n int) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.BytesIn += uint64(n)
+	cs.Unlock()
+}
+
+func (s *buffManagerStats) BytesOut(address string, n int) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.BytesOut += uint64(n)
+	cs.Unlock()
+}
+
+func (s *buffManagerStats) MessagesIn(address string) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.MessagesIn++
+	cs.Unlock()
+}
+
+func (s *buffManagerStats) MessagesOut(address string) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.MessagesOut++
+	cs.Unlock()
+}
+
+func (s *buffManagerStats) ActiveConns(address string, delta int) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.ActiveConns += delta
+	cs.Unlock()
+}
+
+func (s *buffManagerStats) HandshakeFailure(address string) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.HandshakeFailures++
+	cs.Unlock()
+}
+
+func (s *buffManagerStats) FramingError(address string) {
+	cs := s.entry(address)
+	cs.Lock()
+	cs.ConnStats.FramingErrors++
+	cs.Unlock()
+}
+
+// snapshot returns a copy of address's counters.
+func (s *buffManagerStats) snapshot(address string) ConnStats {
+	cs := s.entry(address)
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.ConnStats
+}
+
+// total returns the sum of every address's counters.
+func (s *buffManagerStats) total() ConnStats {
+	s.Lock()
+	addresses := make([]*connStats, 0, len(s.byAddress))
+	for _, cs := range s.byAddress {
+		addresses = append(addresses, cs)
+	}
+	s.Unlock()
+
+	var total ConnStats
+	for _, cs := range addresses {
+		cs.Lock()
+		total.BytesIn += cs.ConnStats.BytesIn
+		total.BytesOut += cs.ConnStats.BytesOut
+		total.MessagesIn += cs.ConnStats.MessagesIn
+		total.MessagesOut += cs.ConnStats.MessagesOut
+		total.ActiveConns += cs.ConnStats.ActiveConns
+		total.HandshakeFailures += cs.ConnStats.HandshakeFailures
+		total.FramingErrors += cs.ConnStats.FramingErrors
+		cs.Unlock()
+	}
+	return total
+}
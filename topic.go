@@ -0,0 +1,42 @@
+package buffstreams
+
+import "fmt"
+
+// Size, in bytes, of the length-prefixed topic name ahead of every
+// message's payload. One byte is plenty for any reasonable topic string.
+const topicHeaderByteSize = 1
+
+// Longest topic name topicHeaderByteSize can frame.
+const maxTopicLength = 1<<(8*topicHeaderByteSize) - 1
+
+// Topic used by the plain byte-only API (StartListening, WriteTo), so
+// Mux-based and non-Mux peers can talk without either side knowing the
+// other uses topics.
+const defaultTopic = ""
+
+// Prepends data with topic's length-prefixed name, so every message gets a
+// small routable header whether or not the reader uses a Mux.
+func encodeTopicFrame(topic string, data []byte) ([]byte, error) {
+	if len(topic) > maxTopicLength {
+		return nil, fmt.Errorf("buffstreams: topic %q is longer than %d bytes", topic, maxTopicLength)
+	}
+	frame := make([]byte, 0, topicHeaderByteSize+len(topic)+len(data))
+	frame = append(frame, byte(len(topic)))
+	frame = append(frame, topic...)
+	frame = append(frame, data...)
+	return frame, nil
+}
+
+// Splits a message produced by encodeTopicFrame back into topic + payload.
+func decodeTopicFrame(frame []byte) (string, []byte, error) {
+	if len(frame) < topicHeaderByteSize {
+		return "", nil, errShortHeader
+	}
+	topicLen := int(frame[0])
+	if len(frame) < topicHeaderByteSize+topicLen {
+		return "", nil, errShortHeader
+	}
+	topic := string(frame[topicHeaderByteSize : topicHeaderByteSize+topicLen])
+	payload := frame[topicHeaderByteSize+topicLen:]
+	return topic, payload, nil
+}